@@ -0,0 +1,82 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/flike/kingshard/mysql"
+)
+
+//ConnectContext behaves like Connect but gives up early if ctx is
+//already done.
+//
+//Known limitation: Connect takes no deadline of its own, so a dial or
+//handshake already in flight is not aborted by ctx being cancelled
+//mid-call - only checked before and after. Bounding the dial itself
+//would mean giving Connect a deadline parameter; once a connection is
+//established, execContext's SetDeadline approach does bound every
+//later command on it.
+func (co *Conn) ConnectContext(ctx context.Context, addr, user, password, db string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := co.Connect(addr, user, password, db); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		co.Close()
+		return err
+	}
+
+	return nil
+}
+
+//execContext behaves like exec but bounds it with ctx, applying ctx's
+//deadline to the underlying net.Conn via SetDeadline and forcing an
+//immediate deadline the moment ctx is cancelled. SetDeadline (unlike Close)
+//is safe to call from another goroutine while exec is blocked in
+//Read/Write, so this aborts an in-flight query without racing a
+//concurrent Close against it.
+func (co *Conn) execContext(ctx context.Context, query string) (*mysql.Result, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := co.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer co.SetDeadline(time.Time{})
+	}
+
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				co.SetDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+	}
+
+	result, err := co.exec(query)
+	if err != nil && ctx.Err() != nil {
+		co.Close()
+		return nil, ctx.Err()
+	}
+	return result, err
+}
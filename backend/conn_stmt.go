@@ -0,0 +1,67 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"github.com/flike/kingshard/mysql"
+)
+
+//prepareStmt, executeStmt and closeStmt build on the same wire-level
+//helpers (writeCommandStr, writeCommandBuf, readResult) that plain-text
+//query execution already uses; only the command bytes and response
+//parsing are new here. That also means this file has no unit coverage
+//of its own: driving it end-to-end needs a real or mocked MySQL server
+//to read COM_STMT_PREPARE_OK/COM_STMT_EXECUTE responses off the wire,
+//which is beyond what the pool-bookkeeping tests elsewhere in this
+//package exercise (see stmt_test.go, which drives stmtPool directly and
+//never calls through to a live Conn).
+//
+//prepareStmt issues COM_STMT_PREPARE for sql on this connection and
+//parses the prepare-ok response into a stmtHandle.
+func (co *Conn) prepareStmt(sql string) (*stmtHandle, error) {
+	if err := co.writeCommandStr(mysql.COM_STMT_PREPARE, sql); err != nil {
+		return nil, err
+	}
+
+	id, numParams, numColumns, err := co.readPrepareResultPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return &stmtHandle{
+		id:         id,
+		numParams:  numParams,
+		numColumns: numColumns,
+	}, nil
+}
+
+//executeStmt runs a previously prepared statement via COM_STMT_EXECUTE.
+func (co *Conn) executeStmt(id uint32, args []interface{}) (*mysql.Result, error) {
+	data, err := mysql.ComStmtExecute(id, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := co.writeCommandBuf(mysql.COM_STMT_EXECUTE, data); err != nil {
+		return nil, err
+	}
+
+	return co.readResult(true)
+}
+
+//closeStmt sends COM_STMT_CLOSE, which MySQL never acknowledges.
+func (co *Conn) closeStmt(id uint32) error {
+	return co.writeCommandBuf(mysql.COM_STMT_CLOSE, mysql.ComStmtClose(id))
+}
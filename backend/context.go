@@ -0,0 +1,80 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/flike/kingshard/core/errors"
+	"github.com/flike/kingshard/mysql"
+)
+
+//PopConnContext behaves like PopConn but also watches ctx.Done() while
+//waiting on cacheConns/idleConns, instead of blocking indefinitely on a
+//saturated pool.
+func (db *DB) PopConnContext(ctx context.Context) (*Conn, error) {
+	cacheConns, idleConns := db.getConns()
+	if cacheConns == nil || idleConns == nil {
+		return nil, errors.ErrDatabaseClose
+	}
+
+	var co *Conn
+	var err error
+
+	waitStart := time.Now()
+	select {
+	case co = <-cacheConns:
+	default:
+		select {
+		case co = <-idleConns:
+			db.recordWait(time.Since(waitStart))
+			if err = co.ConnectContext(ctx, db.addr, db.user, db.password, db.db); err != nil {
+				db.closeConn(co)
+				return nil, err
+			}
+			return db.freshConnAcquired(co), nil
+		case co = <-cacheConns:
+			db.recordWait(time.Since(waitStart))
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if co == nil {
+		return nil, errors.ErrConnIsNil
+	}
+
+	co, err = db.cachedConnAcquired(co)
+	if err == errConnExpired {
+		return db.PopConnContext(ctx)
+	}
+	return co, err
+}
+
+//GetConnContext is the context-aware counterpart to GetConn.
+func (db *DB) GetConnContext(ctx context.Context) (*BackendConn, error) {
+	c, err := db.PopConnContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BackendConn{c, db}, nil
+}
+
+//ExecContext runs query on the pooled connection underlying p, aborting
+//as soon as ctx is done.
+func (p *BackendConn) ExecContext(ctx context.Context, query string) (*mysql.Result, error) {
+	return p.Conn.execContext(ctx, query)
+}
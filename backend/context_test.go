@@ -0,0 +1,70 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T) *DB {
+	t.Helper()
+	db := &DB{
+		maxConnNum: 1,
+		idleConns:  make(chan *Conn, 1),
+		cacheConns: make(chan *Conn, 1),
+		stmtPool:   newStmtPool(defaultStmtCacheSize),
+		connEpoch:  newConnEpoch(),
+		timestamps: newConnTimestamps(),
+	}
+	co := new(Conn)
+	db.timestamps.stampNew(co)
+	db.cacheConns <- co
+	return db
+}
+
+func TestPopConnContextMatchesPopConnBookkeeping(t *testing.T) {
+	db := newTestPool(t)
+
+	co, err := db.PopConnContext(context.Background())
+	if err != nil {
+		t.Fatalf("PopConnContext: %v", err)
+	}
+	if got := db.PoolStats().InUse; got != 1 {
+		t.Fatalf("InUse after PopConnContext = %d, want 1", got)
+	}
+
+	db.PushConn(co, nil)
+	if got := db.PoolStats().InUse; got != 0 {
+		t.Fatalf("InUse after PushConn = %d, want 0", got)
+	}
+}
+
+func TestPopConnContextHonorsMaxLifetime(t *testing.T) {
+	db := newTestPool(t)
+	db.SetConnMaxLifetime(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := db.PopConnContext(ctx); err == nil {
+		t.Fatal("PopConnContext returned the stale connection instead of discarding it per SetConnMaxLifetime")
+	}
+	if got := db.PoolStats().MaxLifetimeClosed; got != 1 {
+		t.Fatalf("MaxLifetimeClosed = %d, want 1", got)
+	}
+}
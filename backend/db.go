@@ -15,8 +15,10 @@
 package backend
 
 import (
+	goerrors "errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flike/kingshard/core/errors"
 	"github.com/flike/kingshard/mysql"
@@ -45,6 +47,20 @@ type DB struct {
 	idleConns   chan *Conn
 	cacheConns  chan *Conn
 	checkConn   *Conn
+
+	stmtPool  *stmtPool
+	connEpoch *connEpoch
+	health    *healthChecker
+	standby   *DB
+
+	counters  poolCounters
+	statsHook func(event StatsEvent, co *Conn)
+
+	timestamps      *connTimestamps
+	maxConnLifetime time.Duration
+	maxConnIdleTime time.Duration
+	reapStop        chan struct{}
+	reapDone        chan struct{}
 }
 
 func Open(addr string, user string, password string, dbName string, maxConnNum int) (*DB, error) {
@@ -75,6 +91,9 @@ func Open(addr string, user string, password string, dbName string, maxConnNum i
 
 	db.idleConns = make(chan *Conn, db.maxConnNum)
 	db.cacheConns = make(chan *Conn, db.maxConnNum)
+	db.stmtPool = newStmtPool(defaultStmtCacheSize)
+	db.connEpoch = newConnEpoch()
+	db.timestamps = newConnTimestamps()
 	atomic.StoreInt32(&(db.state), Unknown)
 
 	for i := 0; i < db.maxConnNum; i++ {
@@ -91,6 +110,8 @@ func Open(addr string, user string, password string, dbName string, maxConnNum i
 		}
 	}
 
+	db.startReaper()
+
 	return db, nil
 }
 
@@ -123,7 +144,22 @@ func (db *DB) Close() error {
 	cacheChannel := db.cacheConns
 	db.cacheConns = nil
 	db.idleConns = nil
+	reapStop := db.reapStop
+	reapDone := db.reapDone
+	db.reapStop = nil
+	db.reapDone = nil
 	db.Unlock()
+
+	db.StopHealthCheck()
+
+	if reapStop != nil {
+		close(reapStop)
+		//wait for any in-flight reapOnce to finish before we tear down
+		//cacheChannel below, otherwise a reap tick that already popped a
+		//conn off cacheChannel can try to send it back on a channel
+		//we're about to close and panic.
+		<-reapDone
+	}
 	if cacheChannel == nil || idleChannel == nil {
 		return nil
 	}
@@ -177,12 +213,24 @@ func (db *DB) newConn() (*Conn, error) {
 		return nil, err
 	}
 
+	atomic.AddInt64(&db.counters.openConns, 1)
+	db.timestamps.stampNew(co)
+	db.fireStats(StatsConnOpened, co)
+
 	return co, nil
 }
 
 func (db *DB) closeConn(co *Conn) error {
 	if co != nil {
+		db.stmtPool.forget(co)
+		db.timestamps.forget(co)
 		co.Close()
+		atomic.AddInt64(&db.counters.openConns, -1)
+		db.fireStats(StatsConnClosed, co)
+		if db.getIdleConns() == nil {
+			//Close has already torn the pool down
+			return nil
+		}
 		conns := db.getIdleConns()
 		conns <- co
 	}
@@ -191,6 +239,14 @@ func (db *DB) closeConn(co *Conn) error {
 
 func (db *DB) tryReuse(co *Conn) error {
 	var err error
+
+	//close out any statements evicted by another connection's Prepare
+	//while co was checked out or idle in cacheConns; we own co now, so
+	//this is the first safe point to write COM_STMT_CLOSE for them.
+	for _, h := range db.stmtPool.takePendingClose(co) {
+		co.closeStmt(h.id)
+	}
+
 	//reuse Connection
 	if co.IsInTransaction() {
 		//we can not reuse a connection in transaction status
@@ -220,6 +276,47 @@ func (db *DB) tryReuse(co *Conn) error {
 	return nil
 }
 
+//freshConnAcquired finishes the bookkeeping for a connection just
+//dialed from idleConns; shared by PopConn and PopConnContext.
+func (db *DB) freshConnAcquired(co *Conn) *Conn {
+	atomic.AddInt64(&db.counters.openConns, 1)
+	atomic.AddInt64(&db.counters.inUse, 1)
+	db.timestamps.stampNew(co)
+	db.connEpoch.bump(co)
+	db.fireStats(StatsConnOpened, co)
+	db.fireStats(StatsConnPopped, co)
+	return co
+}
+
+//errConnExpired signals that a cacheConns hit was past its configured
+//lifetime/idle bound and the caller should pop again.
+var errConnExpired = goerrors.New("backend: pooled connection expired")
+
+//cachedConnAcquired finishes the bookkeeping for a connection pulled
+//from cacheConns, discarding it (and returning errConnExpired so the
+//caller retries) if it is past SetConnMaxLifetime/SetConnMaxIdleTime;
+//shared by PopConn and PopConnContext.
+func (db *DB) cachedConnAcquired(co *Conn) (*Conn, error) {
+	if maxLifetime, maxIdleTime := db.lifetimeBounds(); db.timestamps.expired(co, maxLifetime, maxIdleTime) {
+		db.timestamps.forget(co)
+		db.closeConn(co)
+		atomic.AddInt64(&db.counters.maxLifetimeClosed, 1)
+		db.fireStats(StatsClosedMaxLifetime, co)
+		return nil, errConnExpired
+	}
+
+	if err := db.tryReuse(co); err != nil {
+		db.closeConn(co)
+		return nil, err
+	}
+
+	atomic.AddInt64(&db.counters.inUse, 1)
+	db.connEpoch.bump(co)
+	db.fireStats(StatsConnPopped, co)
+
+	return co, nil
+}
+
 func (db *DB) PopConn() (*Conn, error) {
 	var co *Conn
 	var err error
@@ -232,29 +329,30 @@ func (db *DB) PopConn() (*Conn, error) {
 	if 0 < len(cacheConns) {
 		co = <-cacheConns
 	} else {
+		waitStart := time.Now()
 		select {
 		case co = <-idleConns:
+			db.recordWait(time.Since(waitStart))
 			err = co.Connect(db.addr, db.user, db.password, db.db)
 			if err != nil {
 				db.closeConn(co)
 				return nil, err
 			}
-			return co, nil
+			return db.freshConnAcquired(co), nil
 		case co = <-cacheConns:
-			break
+			db.recordWait(time.Since(waitStart))
 		}
 	}
 
 	if co == nil {
 		return nil, errors.ErrConnIsNil
 	}
-	err = db.tryReuse(co)
-	if err != nil {
-		db.closeConn(co)
-		return nil, err
-	}
 
-	return co, nil
+	co, err = db.cachedConnAcquired(co)
+	if err == errConnExpired {
+		return db.PopConn()
+	}
+	return co, err
 }
 
 func (db *DB) PushConn(co *Conn, err error) {
@@ -266,13 +364,17 @@ func (db *DB) PushConn(co *Conn, err error) {
 		co.Close()
 		return
 	}
+	atomic.AddInt64(&db.counters.inUse, -1)
 	if err != nil {
 		db.closeConn(co)
 		return
 	}
 
+	db.timestamps.touch(co)
+
 	select {
 	case conns <- co:
+		db.fireStats(StatsConnPushed, co)
 		return
 	default:
 		db.closeConn(co)
@@ -0,0 +1,312 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"context"
+	goerrors "errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ErrDatabaseDown is returned by GetConnFailFast while the active health
+//check has db marked Down and no standby is configured.
+var ErrDatabaseDown = goerrors.New("backend: database is marked down")
+
+//HealthCheckConfig controls the active probe loop started by
+//DB.StartHealthCheck, which replaces manually calling Ping and setting
+//db.state by hand.
+type HealthCheckConfig struct {
+	Interval         time.Duration
+	Timeout          time.Duration
+	UpThreshold      int //consecutive successful probes needed to go Up
+	DownThreshold    int //consecutive failed probes needed to go Down
+	CheckReplication bool
+	MaxBackoff       time.Duration //cap on the exponential backoff between probes while failing
+}
+
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Interval:      3 * time.Second,
+		Timeout:       time.Second,
+		UpThreshold:   2,
+		DownThreshold: 3,
+		MaxBackoff:    30 * time.Second,
+	}
+}
+
+//HealthEvent is emitted whenever a probe flips db's reported state.
+type HealthEvent struct {
+	Addr      string
+	State     int32
+	Err       error
+	Timestamp time.Time
+}
+
+//NodeStats is a snapshot of what the active health check currently
+//knows about a node, for use by monitoring/metrics code.
+type NodeStats struct {
+	LastProbeLatency  time.Duration
+	ConsecutiveFails  int
+	ReplicationLagSec int64
+}
+
+type healthChecker struct {
+	db     *DB
+	cfg    HealthCheckConfig
+	events chan HealthEvent
+	stopCh chan struct{}
+
+	mu                sync.Mutex
+	consecutiveOK     int
+	consecutiveFail   int
+	lastProbeLatency  time.Duration
+	replicationLagSec int64
+}
+
+//StartHealthCheck launches a background goroutine that probes db on
+//cfg.Interval and transitions db.state between Up/Down/Unknown with
+//hysteresis. It is a no-op if a health check is already running for db.
+func (db *DB) StartHealthCheck(cfg HealthCheckConfig) <-chan HealthEvent {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.health != nil {
+		return db.health.events
+	}
+
+	h := &healthChecker{
+		db:     db,
+		cfg:    cfg,
+		events: make(chan HealthEvent, 16),
+		stopCh: make(chan struct{}),
+	}
+	db.health = h
+
+	go h.run()
+
+	return h.events
+}
+
+//StopHealthCheck stops the probe loop started by StartHealthCheck.
+func (db *DB) StopHealthCheck() {
+	db.Lock()
+	h := db.health
+	db.health = nil
+	db.Unlock()
+
+	if h != nil {
+		close(h.stopCh)
+	}
+}
+
+//Stats returns the health check's current view of db. The zero value
+//is returned if no health check is running.
+func (db *DB) Stats() NodeStats {
+	db.RLock()
+	h := db.health
+	db.RUnlock()
+	if h == nil {
+		return NodeStats{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return NodeStats{
+		LastProbeLatency:  h.lastProbeLatency,
+		ConsecutiveFails:  h.consecutiveFail,
+		ReplicationLagSec: h.replicationLagSec,
+	}
+}
+
+func (h *healthChecker) run() {
+	backoff := h.cfg.Interval
+	for {
+		select {
+		case <-h.stopCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		err := h.probe()
+		if err != nil {
+			backoff *= 2
+			if backoff > h.cfg.MaxBackoff {
+				backoff = h.cfg.MaxBackoff
+			}
+		} else {
+			backoff = h.cfg.Interval
+		}
+	}
+}
+
+//probe runs the configured checks once and applies the hysteresis
+//transition, draining stale cached connections on a Down->Up flip.
+func (h *healthChecker) probe() error {
+	start := time.Now()
+	err := h.ping()
+	latency := time.Since(start)
+
+	h.mu.Lock()
+	h.lastProbeLatency = latency
+	h.mu.Unlock()
+
+	if h.cfg.CheckReplication && err == nil {
+		if lag, lagErr := h.probeReplicationLag(); lagErr == nil {
+			h.mu.Lock()
+			h.replicationLagSec = lag
+			h.mu.Unlock()
+		}
+	}
+
+	h.transition(err)
+
+	return err
+}
+
+//probeTimeout derives a bounded context from cfg.Timeout, or an
+//unbounded one if no timeout is configured.
+func (h *healthChecker) probeTimeout() (context.Context, context.CancelFunc) {
+	if h.cfg.Timeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), h.cfg.Timeout)
+}
+
+//ping runs a bounded "SELECT 1" instead of calling db.Ping() directly,
+//so a wedged backend that accepted the TCP connection but never
+//answers can't block the probe loop (and the down-detection hysteresis
+//it drives) forever.
+func (h *healthChecker) ping() error {
+	ctx, cancel := h.probeTimeout()
+	defer cancel()
+
+	co, err := h.db.GetConnContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	_, err = co.ExecContext(ctx, "SELECT 1")
+	return err
+}
+
+//probeReplicationLag, like ping, goes through GetConnContext/Close
+//instead of a bare PopConnContext/PushConn so a connection left
+//protocol-desynced by a mid-read context timeout (execContext's
+//SetDeadline aborting the read) is closed rather than handed back to
+//cacheConns as healthy - Close checks co.pkgErr and routes to closeConn
+//whenever the command above it failed.
+func (h *healthChecker) probeReplicationLag() (int64, error) {
+	ctx, cancel := h.probeTimeout()
+	defer cancel()
+
+	co, err := h.db.GetConnContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer co.Close()
+
+	result, err := co.execContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+
+	return result.GetIntByName(0, "Seconds_Behind_Master")
+}
+
+//transition applies one probe result to the hysteresis counters and
+//flips db.state if a threshold was just crossed.
+func (h *healthChecker) transition(probeErr error) {
+	h.mu.Lock()
+	if probeErr == nil {
+		h.consecutiveOK++
+		h.consecutiveFail = 0
+	} else {
+		h.consecutiveFail++
+		h.consecutiveOK = 0
+	}
+	consecutiveOK, consecutiveFail := h.consecutiveOK, h.consecutiveFail
+	h.mu.Unlock()
+
+	prevState := atomic.LoadInt32(&h.db.state)
+	switch {
+	case probeErr != nil && consecutiveFail >= h.cfg.DownThreshold && prevState != Down:
+		atomic.StoreInt32(&h.db.state, Down)
+		h.emit(Down, probeErr)
+	case probeErr == nil && consecutiveOK >= h.cfg.UpThreshold && prevState != Up:
+		atomic.StoreInt32(&h.db.state, Up)
+		h.db.drainStaleConns()
+		h.emit(Up, nil)
+	}
+}
+
+func (h *healthChecker) emit(state int32, err error) {
+	evt := HealthEvent{Addr: h.db.addr, State: state, Err: err, Timestamp: time.Now()}
+	select {
+	case h.events <- evt:
+	default:
+		//a slow/absent consumer must not block the probe loop
+	}
+}
+
+//drainStaleConns discards every currently pooled connection; the
+//server may have closed them out from under us while the node was Down.
+func (db *DB) drainStaleConns() {
+	cacheConns := db.getCacheConns()
+	if cacheConns == nil {
+		return
+	}
+
+	for {
+		select {
+		case co := <-cacheConns:
+			db.closeConn(co)
+			atomic.AddInt64(&db.counters.healthClosed, 1)
+			db.fireStats(StatsClosedHealth, co)
+		default:
+			return
+		}
+	}
+}
+
+//SetStandby configures standby as the node GetConnFailFast promotes
+//traffic to once db is marked Down. Pass nil to clear it.
+func (db *DB) SetStandby(standby *DB) {
+	db.Lock()
+	defer db.Unlock()
+	db.standby = standby
+}
+
+func (db *DB) getStandby() *DB {
+	db.RLock()
+	defer db.RUnlock()
+	return db.standby
+}
+
+//GetConnFailFast behaves like GetConn but fails immediately with
+//ErrDatabaseDown while db is marked Down, instead of handing the caller
+//a connection likely to fail anyway. A standby configured with
+//SetStandby is promoted instead of failing the call.
+func (db *DB) GetConnFailFast() (*BackendConn, error) {
+	if atomic.LoadInt32(&db.state) == Down {
+		if standby := db.getStandby(); standby != nil {
+			return standby.GetConn()
+		}
+		return nil, ErrDatabaseDown
+	}
+	return db.GetConn()
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestHealthChecker(cfg HealthCheckConfig) *healthChecker {
+	db := &DB{}
+	return &healthChecker{db: db, cfg: cfg, events: make(chan HealthEvent, 4)}
+}
+
+func TestHealthCheckerHysteresisRequiresConsecutiveResults(t *testing.T) {
+	h := newTestHealthChecker(HealthCheckConfig{UpThreshold: 2, DownThreshold: 2})
+	probeErr := errors.New("boom")
+
+	h.transition(probeErr)
+	if got := h.db.State(); got == "down" {
+		t.Fatal("state flipped to down after a single failure, want DownThreshold consecutive failures")
+	}
+
+	h.transition(probeErr)
+	if got := h.db.State(); got != "down" {
+		t.Fatalf("state after 2 consecutive failures = %q, want down", got)
+	}
+
+	h.transition(nil)
+	if got := h.db.State(); got != "down" {
+		t.Fatalf("state after 1 success = %q, want still down", got)
+	}
+
+	h.transition(nil)
+	if got := h.db.State(); got != "up" {
+		t.Fatalf("state after 2 consecutive successes = %q, want up", got)
+	}
+}
+
+func TestHealthCheckerEmitsOnlyOnStateChange(t *testing.T) {
+	h := newTestHealthChecker(HealthCheckConfig{UpThreshold: 1, DownThreshold: 1})
+
+	h.transition(errors.New("boom"))
+	h.transition(errors.New("boom again"))
+
+	var events int
+drain:
+	for {
+		select {
+		case <-h.events:
+			events++
+		default:
+			break drain
+		}
+	}
+	if events != 1 {
+		t.Fatalf("got %d events for repeated Down reports, want 1", events)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//defaultReapInterval is how often the background reaper walks
+//cacheConns looking for connections past their lifetime/idle bound.
+const defaultReapInterval = time.Minute
+
+//connTimestamps tracks per-*Conn creation/last-use times without a
+//field on Conn itself, the same side-table pattern stmtPool uses.
+type connTimestamps struct {
+	sync.Mutex
+	createdAt  map[*Conn]time.Time
+	lastUsedAt map[*Conn]time.Time
+}
+
+func newConnTimestamps() *connTimestamps {
+	return &connTimestamps{
+		createdAt:  make(map[*Conn]time.Time),
+		lastUsedAt: make(map[*Conn]time.Time),
+	}
+}
+
+func (t *connTimestamps) stampNew(co *Conn) {
+	now := time.Now()
+	t.Lock()
+	t.createdAt[co] = now
+	t.lastUsedAt[co] = now
+	t.Unlock()
+}
+
+func (t *connTimestamps) touch(co *Conn) {
+	t.Lock()
+	t.lastUsedAt[co] = time.Now()
+	t.Unlock()
+}
+
+func (t *connTimestamps) forget(co *Conn) {
+	t.Lock()
+	delete(t.createdAt, co)
+	delete(t.lastUsedAt, co)
+	t.Unlock()
+}
+
+//expired reports whether co has been alive longer than maxLifetime or
+//idle longer than maxIdleTime. A zero duration means that bound is
+//disabled.
+func (t *connTimestamps) expired(co *Conn, maxLifetime, maxIdleTime time.Duration) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if maxLifetime > 0 {
+		if created, ok := t.createdAt[co]; ok && now.Sub(created) >= maxLifetime {
+			return true
+		}
+	}
+	if maxIdleTime > 0 {
+		if used, ok := t.lastUsedAt[co]; ok && now.Sub(used) >= maxIdleTime {
+			return true
+		}
+	}
+	return false
+}
+
+//SetConnMaxLifetime bounds how long a pooled connection may live before
+//PopConn (or the background reaper) discards it. A duration <= 0 means
+//no limit, the default.
+func (db *DB) SetConnMaxLifetime(d time.Duration) {
+	db.Lock()
+	defer db.Unlock()
+	db.maxConnLifetime = d
+}
+
+//SetConnMaxIdleTime bounds how long a pooled connection may sit idle in
+//cacheConns before it is discarded. A duration <= 0 means no limit.
+func (db *DB) SetConnMaxIdleTime(d time.Duration) {
+	db.Lock()
+	defer db.Unlock()
+	db.maxConnIdleTime = d
+}
+
+func (db *DB) lifetimeBounds() (time.Duration, time.Duration) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.maxConnLifetime, db.maxConnIdleTime
+}
+
+//startReaper launches the background goroutine that periodically walks
+//cacheConns and discards connections past SetConnMaxLifetime /
+//SetConnMaxIdleTime.
+func (db *DB) startReaper() {
+	db.reapStop = make(chan struct{})
+	db.reapDone = make(chan struct{})
+	go db.reapLoop(db.reapStop, db.reapDone)
+}
+
+//reapLoop runs until stop is closed, then closes done so Close can wait
+//for a reap tick already in flight to finish before it tears down
+//cacheConns/idleConns out from under it.
+func (db *DB) reapLoop(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(defaultReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			db.reapOnce()
+		}
+	}
+}
+
+func (db *DB) reapOnce() {
+	maxLifetime, maxIdleTime := db.lifetimeBounds()
+	if maxLifetime <= 0 && maxIdleTime <= 0 {
+		return
+	}
+
+	cacheConns := db.getCacheConns()
+	if cacheConns == nil {
+		return
+	}
+
+	n := len(cacheConns)
+	for i := 0; i < n; i++ {
+		var co *Conn
+		select {
+		case co = <-cacheConns:
+		default:
+			return
+		}
+
+		if db.timestamps.expired(co, maxLifetime, maxIdleTime) {
+			db.timestamps.forget(co)
+			db.closeConn(co)
+			atomic.AddInt64(&db.counters.maxLifetimeClosed, 1)
+			db.fireStats(StatsClosedMaxLifetime, co)
+			continue
+		}
+
+		select {
+		case cacheConns <- co:
+		default:
+			db.closeConn(co)
+		}
+	}
+}
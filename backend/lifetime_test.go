@@ -0,0 +1,115 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapOnceDiscardsOnlyExpiredConnections(t *testing.T) {
+	db := &DB{
+		idleConns:  make(chan *Conn, 2),
+		cacheConns: make(chan *Conn, 2),
+		stmtPool:   newStmtPool(defaultStmtCacheSize),
+		connEpoch:  newConnEpoch(),
+		timestamps: newConnTimestamps(),
+	}
+
+	stale := new(Conn)
+	db.timestamps.stampNew(stale)
+	db.cacheConns <- stale
+
+	time.Sleep(5 * time.Millisecond)
+	db.SetConnMaxLifetime(2 * time.Millisecond)
+
+	fresh := new(Conn)
+	db.timestamps.stampNew(fresh)
+	db.cacheConns <- fresh
+
+	db.reapOnce()
+
+	if got := db.PoolStats().MaxLifetimeClosed; got != 1 {
+		t.Fatalf("MaxLifetimeClosed = %d, want 1", got)
+	}
+	if got := len(db.cacheConns); got != 1 {
+		t.Fatalf("cacheConns has %d entries after reapOnce, want 1 (the fresh connection)", got)
+	}
+	if remaining := <-db.cacheConns; remaining != fresh {
+		t.Fatal("reapOnce kept the stale connection and discarded the fresh one")
+	}
+}
+
+func TestCloseWaitsForInFlightReapBeforeClosingCacheConns(t *testing.T) {
+	db := &DB{
+		cacheConns: make(chan *Conn, 1),
+		idleConns:  make(chan *Conn, 1),
+		stmtPool:   newStmtPool(defaultStmtCacheSize),
+		connEpoch:  newConnEpoch(),
+		timestamps: newConnTimestamps(),
+		reapStop:   make(chan struct{}),
+		reapDone:   make(chan struct{}),
+	}
+	co := new(Conn)
+	db.timestamps.stampNew(co)
+
+	//like reapLoop/reapOnce, hold on to the channels captured before
+	//Close nils the fields on db.
+	reapStop, reapDone, cacheConns := db.reapStop, db.reapDone, db.cacheConns
+	reapFinished := make(chan struct{})
+	go func() {
+		<-reapStop
+		//simulate a reap tick that had already popped co off cacheConns
+		//before Close was called, and is only now getting around to
+		//sending it back - the window that used to panic with "send on
+		//closed channel" if Close tore cacheConns down first.
+		time.Sleep(20 * time.Millisecond)
+		cacheConns <- co
+		close(reapFinished)
+		close(reapDone)
+	}()
+
+	start := time.Now()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("Close returned after %v, want it to block until the in-flight reap tick finished", elapsed)
+	}
+	select {
+	case <-reapFinished:
+	default:
+		t.Fatal("Close did not wait for the reaper to finish before tearing down cacheConns")
+	}
+}
+
+func TestReapOnceIsNoopWithoutBounds(t *testing.T) {
+	db := &DB{
+		idleConns:  make(chan *Conn, 1),
+		cacheConns: make(chan *Conn, 1),
+		stmtPool:   newStmtPool(defaultStmtCacheSize),
+		connEpoch:  newConnEpoch(),
+		timestamps: newConnTimestamps(),
+	}
+	co := new(Conn)
+	db.timestamps.stampNew(co)
+	db.cacheConns <- co
+
+	db.reapOnce()
+
+	if got := len(db.cacheConns); got != 1 {
+		t.Fatalf("cacheConns has %d entries after reapOnce with no bounds set, want 1 (untouched)", got)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//Package metrics adapts backend.DB's pool counters to Prometheus.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/flike/kingshard/backend"
+)
+
+//Collector exposes one backend.DB's PoolStats as Prometheus metrics,
+//labeled by the node's address.
+type Collector struct {
+	db *backend.DB
+
+	openConns         *prometheus.Desc
+	inUse             *prometheus.Desc
+	idle              *prometheus.Desc
+	waitCount         *prometheus.Desc
+	waitDuration      *prometheus.Desc
+	maxLifetimeClosed *prometheus.Desc
+	healthClosed      *prometheus.Desc
+}
+
+//NewCollector builds a Collector for db. Pass the result to
+//prometheus.MustRegister (or a Registerer) to mount it.
+func NewCollector(db *backend.DB) *Collector {
+	labels := []string{"addr"}
+	return &Collector{
+		db: db,
+
+		openConns: prometheus.NewDesc(
+			"kingshard_backend_open_connections",
+			"Open backend connections.", labels, nil),
+		inUse: prometheus.NewDesc(
+			"kingshard_backend_in_use_connections",
+			"Backend connections currently checked out of the pool.", labels, nil),
+		idle: prometheus.NewDesc(
+			"kingshard_backend_idle_connections",
+			"Idle backend connections sitting in the pool.", labels, nil),
+		waitCount: prometheus.NewDesc(
+			"kingshard_backend_wait_count_total",
+			"Total number of times a caller waited for a connection.", labels, nil),
+		waitDuration: prometheus.NewDesc(
+			"kingshard_backend_wait_duration_seconds_total",
+			"Total time spent waiting for a connection.", labels, nil),
+		maxLifetimeClosed: prometheus.NewDesc(
+			"kingshard_backend_max_lifetime_closed_total",
+			"Connections closed for exceeding their max lifetime or max idle time.", labels, nil),
+		healthClosed: prometheus.NewDesc(
+			"kingshard_backend_health_closed_total",
+			"Pooled connections discarded by the active health check when the node came back up.", labels, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openConns
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.maxLifetimeClosed
+	ch <- c.healthClosed
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.PoolStats()
+	addr := c.db.Addr()
+
+	ch <- prometheus.MustNewConstMetric(c.openConns, prometheus.GaugeValue, float64(stats.OpenConns), addr)
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse), addr)
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle), addr)
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount), addr)
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds(), addr)
+	ch <- prometheus.MustNewConstMetric(c.maxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), addr)
+	ch <- prometheus.MustNewConstMetric(c.healthClosed, prometheus.CounterValue, float64(stats.HealthClosed), addr)
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/flike/kingshard/backend"
+)
+
+func TestCollectorDescribeAndCollectEmitSevenMetrics(t *testing.T) {
+	db, err := backend.Open("127.0.0.1:3306", "root", "", "test", 4)
+	if err != nil {
+		t.Skipf("no backend available to open a pool against: %v", err)
+	}
+	defer db.Close()
+
+	c := NewCollector(db)
+
+	descs := make(chan *prometheus.Desc, 16)
+	c.Describe(descs)
+	close(descs)
+	if got := len(descs); got != 7 {
+		t.Fatalf("Describe emitted %d descs, want 7", got)
+	}
+
+	metrics := make(chan prometheus.Metric, 16)
+	c.Collect(metrics)
+	close(metrics)
+	if got := len(metrics); got != 7 {
+		t.Fatalf("Collect emitted %d metrics, want 7", got)
+	}
+}
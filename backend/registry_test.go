@@ -0,0 +1,53 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import "testing"
+
+func TestOpenURLDispatchesToRegisteredScheme(t *testing.T) {
+	var gotAddr, gotUser, gotPassword, gotDB string
+	Register("kingshard-test-dispatch", func(addr, user, password, dbName string, maxConnNum int) (Pool, error) {
+		gotAddr, gotUser, gotPassword, gotDB = addr, user, password, dbName
+		return nil, nil
+	})
+
+	if _, err := OpenURL("kingshard-test-dispatch://u:p@host:1234/mydb", 4); err != nil {
+		t.Fatalf("OpenURL: %v", err)
+	}
+	if gotAddr != "host:1234" || gotUser != "u" || gotPassword != "p" || gotDB != "mydb" {
+		t.Fatalf("factory got (%q, %q, %q, %q), want (host:1234, u, p, mydb)", gotAddr, gotUser, gotPassword, gotDB)
+	}
+}
+
+func TestOpenURLUnknownScheme(t *testing.T) {
+	if _, err := OpenURL("kingshard-test-unregistered://host/db", 4); err == nil {
+		t.Fatal("OpenURL with an unregistered scheme should return an error")
+	}
+}
+
+func TestRegisterPanicsOnDuplicateScheme(t *testing.T) {
+	Register("kingshard-test-dup", func(addr, user, password, dbName string, maxConnNum int) (Pool, error) {
+		return nil, nil
+	})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Register should panic on a duplicate scheme")
+		}
+	}()
+	Register("kingshard-test-dup", func(addr, user, password, dbName string, maxConnNum int) (Pool, error) {
+		return nil, nil
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//StatsEvent identifies why a stats hook registered with SetStatsHook
+//was invoked.
+type StatsEvent string
+
+const (
+	StatsConnOpened        StatsEvent = "conn_opened"
+	StatsConnPopped        StatsEvent = "conn_popped"
+	StatsConnPushed        StatsEvent = "conn_pushed"
+	StatsConnClosed        StatsEvent = "conn_closed"
+	StatsClosedMaxLifetime StatsEvent = "closed_max_lifetime"
+	StatsClosedHealth      StatsEvent = "closed_health"
+)
+
+//Stats is a snapshot of a DB's pool counters, modeled on
+//database/sql.DBStats.
+type Stats struct {
+	OpenConns         int64
+	InUse             int64
+	Idle              int64
+	WaitCount         int64
+	WaitDuration      time.Duration
+	MaxLifetimeClosed int64
+	HealthClosed      int64
+}
+
+//poolCounters are the atomically-updated fields behind PoolStats.
+type poolCounters struct {
+	openConns         int64
+	inUse             int64
+	waitCount         int64
+	waitDurationNanos int64
+	maxLifetimeClosed int64
+	healthClosed      int64
+}
+
+//SetStatsHook registers a callback fired on every pool event (a
+//connection opened, popped, pushed back, or closed for a given
+//reason). A nil hook disables the callback.
+func (db *DB) SetStatsHook(hook func(event StatsEvent, co *Conn)) {
+	db.Lock()
+	defer db.Unlock()
+	db.statsHook = hook
+}
+
+func (db *DB) fireStats(event StatsEvent, co *Conn) {
+	db.RLock()
+	hook := db.statsHook
+	db.RUnlock()
+	if hook != nil {
+		hook(event, co)
+	}
+}
+
+func (db *DB) recordWait(d time.Duration) {
+	atomic.AddInt64(&db.counters.waitCount, 1)
+	atomic.AddInt64(&db.counters.waitDurationNanos, int64(d))
+}
+
+//PoolStats returns a snapshot of the pool's current counters.
+func (db *DB) PoolStats() Stats {
+	return Stats{
+		OpenConns:         atomic.LoadInt64(&db.counters.openConns),
+		InUse:             atomic.LoadInt64(&db.counters.inUse),
+		Idle:              int64(db.IdleConnCount()),
+		WaitCount:         atomic.LoadInt64(&db.counters.waitCount),
+		WaitDuration:      time.Duration(atomic.LoadInt64(&db.counters.waitDurationNanos)),
+		MaxLifetimeClosed: atomic.LoadInt64(&db.counters.maxLifetimeClosed),
+		HealthClosed:      atomic.LoadInt64(&db.counters.healthClosed),
+	}
+}
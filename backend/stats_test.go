@@ -0,0 +1,59 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import "testing"
+
+func TestStatsHookFiresOnPopAndPush(t *testing.T) {
+	db := newTestPool(t)
+
+	var events []StatsEvent
+	db.SetStatsHook(func(event StatsEvent, _ *Conn) {
+		events = append(events, event)
+	})
+
+	co, err := db.PopConn()
+	if err != nil {
+		t.Fatalf("PopConn: %v", err)
+	}
+	db.PushConn(co, nil)
+
+	want := []StatsEvent{StatsConnPopped, StatsConnPushed}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i, e := range want {
+		if events[i] != e {
+			t.Fatalf("events[%d] = %q, want %q", i, events[i], e)
+		}
+	}
+}
+
+func TestPoolStatsReflectsInUseCount(t *testing.T) {
+	db := newTestPool(t)
+
+	co, err := db.PopConn()
+	if err != nil {
+		t.Fatalf("PopConn: %v", err)
+	}
+	if got := db.PoolStats().InUse; got != 1 {
+		t.Fatalf("InUse after PopConn = %d, want 1", got)
+	}
+
+	db.PushConn(co, nil)
+	if got := db.PoolStats().InUse; got != 0 {
+		t.Fatalf("InUse after PushConn = %d, want 0", got)
+	}
+}
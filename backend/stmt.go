@@ -0,0 +1,335 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/flike/kingshard/mysql"
+)
+
+//ErrStmtConnReused is returned by Stmt.Execute/Stmt.Close when the
+//*Conn a Stmt was prepared on has since been checked out again by a
+//different caller (see connEpoch) - e.g. because the owning
+//BackendConn was Close()d and tryReuse/freshConnAcquired handed the
+//same *Conn to someone else. Writing to the socket at that point would
+//race the new owner's I/O and corrupt both sessions' protocol streams.
+var ErrStmtConnReused = errors.New("backend: stmt's connection has been reused by another caller")
+
+//number of distinct prepared statements kept warm per DB
+const defaultStmtCacheSize = 256
+
+//normalizedSQL is the cache key for a prepared statement, trimmed so
+//the same query built with slightly different whitespace still hits.
+type normalizedSQL string
+
+func normalizeSQL(sql string) normalizedSQL {
+	return normalizedSQL(strings.TrimSpace(sql))
+}
+
+//stmtHandle is the result of a COM_STMT_PREPARE on one physical
+//connection; statement ids are only valid on the connection that
+//prepared them, so every pooled *Conn keeps its own handle even though
+//stmtPool shares a single LRU of "hot" SQL text across the whole DB.
+type stmtHandle struct {
+	id         uint32
+	numParams  int
+	numColumns int
+}
+
+//stmtPool tracks, per pooled *Conn, which statements it has already
+//prepared, plus an LRU of normalized SQL text bounding how many
+//distinct statements the DB keeps warm across the pool.
+//
+//pendingClose queues handles evicted from a *Conn this pool does not
+//currently own (checked out, or idle in cacheConns and poppable any
+//moment) so COM_STMT_CLOSE is only ever written by whatever goroutine
+//next regains exclusive ownership of that connection via tryReuse,
+//instead of racing a foreign connection's in-flight command.
+type stmtPool struct {
+	sync.Mutex
+
+	capacity     int
+	lru          *list.List
+	index        map[normalizedSQL]*list.Element
+	byConn       map[*Conn]map[normalizedSQL]*stmtHandle
+	pendingClose map[*Conn][]*stmtHandle
+}
+
+func newStmtPool(capacity int) *stmtPool {
+	return &stmtPool{
+		capacity:     capacity,
+		lru:          list.New(),
+		index:        make(map[normalizedSQL]*list.Element),
+		byConn:       make(map[*Conn]map[normalizedSQL]*stmtHandle),
+		pendingClose: make(map[*Conn][]*stmtHandle),
+	}
+}
+
+//touchAndEvict marks sql as recently used and closes out whatever fell
+//off the back of the shared LRU as a result. owner is the connection
+//the caller currently holds exclusively, so its evicted handle (if any)
+//is closed synchronously; every other connection's evicted handle is
+//queued via markPendingClose instead, to avoid racing a foreign
+//connection's in-flight command. Safe to call whether or not sql was
+//just prepared on owner, which is why both BackendConn.Prepare and
+//Stmt.prepare route through it.
+func (p *stmtPool) touchAndEvict(owner *Conn, sql normalizedSQL) {
+	for _, evicted := range p.touch(sql) {
+		if evicted == sql {
+			continue
+		}
+		for co, h := range p.evictAll(evicted) {
+			if co == owner {
+				//owner is ours for the duration of this call, so
+				//closing it here can't race another goroutine.
+				co.closeStmt(h.id)
+				continue
+			}
+			p.markPendingClose(co, h)
+		}
+	}
+}
+
+//touch marks sql as recently used, returning any SQL texts evicted from
+//the LRU as a result (if sql was already present, nothing is evicted).
+func (p *stmtPool) touch(sql normalizedSQL) []normalizedSQL {
+	p.Lock()
+	defer p.Unlock()
+
+	if e, ok := p.index[sql]; ok {
+		p.lru.MoveToFront(e)
+		return nil
+	}
+	p.index[sql] = p.lru.PushFront(sql)
+
+	var evicted []normalizedSQL
+	for p.lru.Len() > p.capacity {
+		back := p.lru.Back()
+		p.lru.Remove(back)
+		key := back.Value.(normalizedSQL)
+		delete(p.index, key)
+		evicted = append(evicted, key)
+	}
+	return evicted
+}
+
+func (p *stmtPool) handle(co *Conn, sql normalizedSQL) (*stmtHandle, bool) {
+	p.Lock()
+	defer p.Unlock()
+	stmts := p.byConn[co]
+	if stmts == nil {
+		return nil, false
+	}
+	h, ok := stmts[sql]
+	return h, ok
+}
+
+func (p *stmtPool) store(co *Conn, sql normalizedSQL, h *stmtHandle) {
+	p.Lock()
+	defer p.Unlock()
+	stmts := p.byConn[co]
+	if stmts == nil {
+		stmts = make(map[normalizedSQL]*stmtHandle)
+		p.byConn[co] = stmts
+	}
+	stmts[sql] = h
+}
+
+//evict drops the handle for sql on co only, used by Stmt.Close while co
+//itself stays in the pool; LRU eviction goes through evictAll instead.
+func (p *stmtPool) evict(co *Conn, sql normalizedSQL) (*stmtHandle, bool) {
+	p.Lock()
+	defer p.Unlock()
+	stmts := p.byConn[co]
+	if stmts == nil {
+		return nil, false
+	}
+	h, ok := stmts[sql]
+	if ok {
+		delete(stmts, sql)
+	}
+	return h, ok
+}
+
+//forget drops every handle cached for co, e.g. because the connection
+//itself is being closed and its statement ids no longer mean anything.
+func (p *stmtPool) forget(co *Conn) map[normalizedSQL]*stmtHandle {
+	p.Lock()
+	defer p.Unlock()
+	stmts := p.byConn[co]
+	delete(p.byConn, co)
+	delete(p.pendingClose, co)
+	return stmts
+}
+
+//evictAll drops the handle for sql on every connection that currently
+//holds it, not just one, returning what was removed. Only strips
+//bookkeeping under p's lock; callers must not send COM_STMT_CLOSE on a
+//returned handle unless they own that connection (see markPendingClose).
+func (p *stmtPool) evictAll(sql normalizedSQL) map[*Conn]*stmtHandle {
+	p.Lock()
+	defer p.Unlock()
+
+	removed := make(map[*Conn]*stmtHandle)
+	for co, stmts := range p.byConn {
+		if h, ok := stmts[sql]; ok {
+			removed[co] = h
+			delete(stmts, sql)
+		}
+	}
+	return removed
+}
+
+//markPendingClose queues h to be closed on co the next time co is
+//popped for reuse (see tryReuse), rather than writing COM_STMT_CLOSE to
+//co's socket from the caller's goroutine right now.
+func (p *stmtPool) markPendingClose(co *Conn, h *stmtHandle) {
+	p.Lock()
+	defer p.Unlock()
+	p.pendingClose[co] = append(p.pendingClose[co], h)
+}
+
+//takePendingClose returns and clears the handles queued for co. Callers
+//must already own co exclusively, which tryReuse does by construction.
+func (p *stmtPool) takePendingClose(co *Conn) []*stmtHandle {
+	p.Lock()
+	defer p.Unlock()
+	pending := p.pendingClose[co]
+	delete(p.pendingClose, co)
+	return pending
+}
+
+//connEpoch counts, per pooled *Conn, how many times it has been handed
+//out to a caller (freshConnAcquired/cachedConnAcquired both bump it on
+//every checkout). A Stmt records the epoch current at Prepare time and
+//refuses to touch the socket once that epoch has moved on, which is
+//what happens when the owning BackendConn is Close()d and the same
+//*Conn is checked out again by someone else via tryReuse.
+type connEpoch struct {
+	sync.Mutex
+	epoch map[*Conn]uint64
+}
+
+func newConnEpoch() *connEpoch {
+	return &connEpoch{epoch: make(map[*Conn]uint64)}
+}
+
+func (e *connEpoch) bump(co *Conn) uint64 {
+	e.Lock()
+	defer e.Unlock()
+	e.epoch[co]++
+	return e.epoch[co]
+}
+
+func (e *connEpoch) current(co *Conn) uint64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.epoch[co]
+}
+
+func (e *connEpoch) forget(co *Conn) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.epoch, co)
+}
+
+//Stmt is a prepared statement bound to a single pooled backend
+//connection. It is obtained via BackendConn.Prepare and executes
+//through the MySQL binary protocol (COM_STMT_EXECUTE) instead of
+//re-sending the SQL text on every call.
+//
+//Execute and Close check epoch against connEpoch before doing any I/O:
+//once the owning BackendConn is Close()d, the underlying *Conn can be
+//handed to a different caller, and a stale Stmt must not write to that
+//caller's socket out from under it.
+type Stmt struct {
+	conn  *Conn
+	db    *DB
+	sql   normalizedSQL
+	epoch uint64
+
+	numParams  int
+	numColumns int
+}
+
+//stale reports whether s's connection has been checked out again by a
+//different caller since s was prepared.
+func (s *Stmt) stale() bool {
+	return s.db.connEpoch.current(s.conn) != s.epoch
+}
+
+//Execute binds args to the statement's placeholders and runs it via
+//COM_STMT_EXECUTE, preparing the statement on the underlying connection
+//first if it has not been prepared there yet.
+func (s *Stmt) Execute(args ...interface{}) (*mysql.Result, error) {
+	if s.stale() {
+		return nil, ErrStmtConnReused
+	}
+
+	h, ok := s.db.stmtPool.handle(s.conn, s.sql)
+	if !ok {
+		var err error
+		h, err = s.prepare()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.conn.executeStmt(h.id, args)
+}
+
+//prepare issues COM_STMT_PREPARE for s.sql on s.conn and re-registers it
+//with the shared LRU. This path is also reached when the per-conn cache
+//hit in Execute misses because the LRU already evicted s.sql out from
+//under a caller still holding this *Stmt, so without the touchAndEvict
+//call here the freshly re-prepared handle would sit in byConn forever,
+//never eligible for eviction again.
+func (s *Stmt) prepare() (*stmtHandle, error) {
+	h, err := s.conn.prepareStmt(string(s.sql))
+	if err != nil {
+		return nil, err
+	}
+	s.db.stmtPool.store(s.conn, s.sql, h)
+	s.db.stmtPool.touchAndEvict(s.conn, s.sql)
+	s.numParams = h.numParams
+	s.numColumns = h.numColumns
+	return h, nil
+}
+
+//Close sends COM_STMT_CLOSE for this statement on its connection and
+//drops it from the pool's cache.
+func (s *Stmt) Close() error {
+	if s.stale() {
+		return ErrStmtConnReused
+	}
+
+	h, ok := s.db.stmtPool.evict(s.conn, s.sql)
+	if !ok {
+		return nil
+	}
+	return s.conn.closeStmt(h.id)
+}
+
+//Prepare returns a Stmt bound to this pooled connection, transparently
+//issuing COM_STMT_PREPARE the first time sql is used on the connection
+//and reusing the cached statement id on later calls.
+func (p *BackendConn) Prepare(sql string) (*Stmt, error) {
+	key := normalizeSQL(sql)
+	p.db.stmtPool.touchAndEvict(p.Conn, key)
+	return &Stmt{conn: p.Conn, db: p.db, sql: key, epoch: p.db.connEpoch.current(p.Conn)}, nil
+}
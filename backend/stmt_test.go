@@ -0,0 +1,163 @@
+// Copyright 2015 The kingshard Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package backend
+
+import "testing"
+
+func TestStmtPoolEvictionDropsHandleFromEveryConnection(t *testing.T) {
+	pool := newStmtPool(1)
+
+	a := new(Conn)
+	b := new(Conn)
+	hot := normalizeSQL("select 1")
+
+	pool.touch(hot)
+	pool.store(a, hot, &stmtHandle{id: 1})
+	pool.store(b, hot, &stmtHandle{id: 2})
+
+	evicted := pool.touch(normalizeSQL("select 2"))
+	if len(evicted) != 1 || evicted[0] != hot {
+		t.Fatalf("touch() evicted = %v, want [%q]", evicted, hot)
+	}
+
+	removed := pool.evictAll(evicted[0])
+	if len(removed) != 2 {
+		t.Fatalf("evictAll removed %d handles, want 2 (one per connection)", len(removed))
+	}
+	if _, ok := pool.handle(a, hot); ok {
+		t.Fatal("connection a should no longer hold the evicted statement")
+	}
+	if _, ok := pool.handle(b, hot); ok {
+		t.Fatal("connection b should no longer hold the evicted statement")
+	}
+}
+
+func TestPendingStmtCloseDeferredUntilOwnedAgain(t *testing.T) {
+	pool := newStmtPool(1)
+	foreign := new(Conn)
+	hot := normalizeSQL("select 1")
+
+	pool.store(foreign, hot, &stmtHandle{id: 7})
+	removed := pool.evictAll(hot)
+	h, ok := removed[foreign]
+	if !ok {
+		t.Fatal("evictAll did not report the handle held by foreign")
+	}
+
+	//evictAll must not have closed it on foreign's socket itself;
+	//closing is deferred until foreign is reused.
+	pool.markPendingClose(foreign, h)
+
+	pending := pool.takePendingClose(foreign)
+	if len(pending) != 1 || pending[0].id != 7 {
+		t.Fatalf("takePendingClose = %v, want [{id:7}]", pending)
+	}
+	if again := pool.takePendingClose(foreign); len(again) != 0 {
+		t.Fatalf("takePendingClose did not drain the queue, got %v", again)
+	}
+}
+
+func TestTouchAndEvictReregistersAReprepareWithTheLRU(t *testing.T) {
+	pool := newStmtPool(1)
+	co := new(Conn)
+	hot := normalizeSQL("select 1")
+
+	//hot starts out tracked by the LRU, same as a real BackendConn.Prepare.
+	pool.touchAndEvict(co, hot)
+	pool.store(co, hot, &stmtHandle{id: 1})
+
+	//the shared LRU evicts hot out from under co, e.g. because another
+	//connection made a different statement hot in the meantime. co's
+	//*Stmt is still alive and unaware its handle is now stale.
+	for _, evicted := range pool.touch(normalizeSQL("select 2")) {
+		pool.evictAll(evicted)
+	}
+	if _, ok := pool.index[hot]; ok {
+		t.Fatal("hot should no longer be tracked by the LRU after eviction")
+	}
+
+	//Stmt.Execute misses the per-conn cache and re-prepares; prepare()
+	//must route back through touchAndEvict so hot is tracked again,
+	//otherwise it can never be selected for eviction and leaks forever.
+	pool.store(co, hot, &stmtHandle{id: 2})
+	pool.touchAndEvict(co, hot)
+	if _, ok := pool.index[hot]; !ok {
+		t.Fatal("re-preparing hot did not re-register it with the shared LRU")
+	}
+
+	//now that hot is tracked again, a later touch can evict it like any
+	//other entry instead of it being stuck warm on co forever.
+	evicted := pool.touch(normalizeSQL("select 2"))
+	if len(evicted) != 1 || evicted[0] != hot {
+		t.Fatalf("touch() evicted = %v, want [%q]", evicted, hot)
+	}
+}
+
+func TestStmtRefusesIOAfterItsConnIsReused(t *testing.T) {
+	db := &DB{stmtPool: newStmtPool(defaultStmtCacheSize), connEpoch: newConnEpoch()}
+	co := new(Conn)
+
+	s := &Stmt{conn: co, db: db, sql: normalizeSQL("select 1"), epoch: db.connEpoch.current(co)}
+	if s.stale() {
+		t.Fatal("freshly prepared Stmt reported stale")
+	}
+
+	//simulate the owning BackendConn being Close()d and co being handed
+	//to a different caller via tryReuse/freshConnAcquired.
+	db.connEpoch.bump(co)
+
+	if !s.stale() {
+		t.Fatal("Stmt did not notice its connection was checked out again")
+	}
+	if _, err := s.Execute(); err != ErrStmtConnReused {
+		t.Fatalf("Execute on a stale Stmt returned err = %v, want ErrStmtConnReused", err)
+	}
+	if err := s.Close(); err != ErrStmtConnReused {
+		t.Fatalf("Close on a stale Stmt returned err = %v, want ErrStmtConnReused", err)
+	}
+}
+
+func TestBackendConnPrepareCapturesCurrentEpoch(t *testing.T) {
+	db := &DB{stmtPool: newStmtPool(defaultStmtCacheSize), connEpoch: newConnEpoch()}
+	co := new(Conn)
+	db.connEpoch.bump(co)
+	db.connEpoch.bump(co)
+
+	p := &BackendConn{co, db}
+	s, err := p.Prepare("select 1")
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if s.stale() {
+		t.Fatal("Stmt should not be stale immediately after Prepare")
+	}
+
+	db.connEpoch.bump(co)
+	if !s.stale() {
+		t.Fatal("Stmt should go stale once co is checked out again")
+	}
+}
+
+func TestStmtPoolTouchIsNoopWhenAlreadyCached(t *testing.T) {
+	pool := newStmtPool(2)
+	key := normalizeSQL("select 1")
+
+	if evicted := pool.touch(key); len(evicted) != 0 {
+		t.Fatalf("first touch evicted %v, want none", evicted)
+	}
+	if evicted := pool.touch(key); len(evicted) != 0 {
+		t.Fatalf("re-touching a cached key evicted %v, want none", evicted)
+	}
+}